@@ -0,0 +1,256 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4easytier
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler routes already-matched EasyTier config-server handshakes to a
+// backend config server, dispatching on the handshake's magic value (or
+// conn_id, as a fallback) so a single listener can serve several EasyTier
+// virtual networks.
+type Handler struct {
+	// Upstreams maps a selector to a backend address. A selector is either
+	// the literal "default", a magic value in hex or decimal (e.g.
+	// "0x0123456789ABCDEF"), or a conn_id prefixed with "conn:" (e.g.
+	// "conn:0xAABBCCDD").
+	Upstreams map[string]string `json:"upstreams,omitempty"`
+
+	defaultUpstream string
+	magicUpstreams  map[uint64]string
+	connIDUpstreams map[uint32]string
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.easytier",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up h, resolving its upstream selectors.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger()
+
+	defaultUpstream, magicUpstreams, connIDUpstreams, err := parseEasyTierUpstreams(h.Upstreams)
+	if err != nil {
+		return err
+	}
+	h.defaultUpstream = defaultUpstream
+	h.magicUpstreams = magicUpstreams
+	h.connIDUpstreams = connIDUpstreams
+
+	return nil
+}
+
+// parseEasyTierUpstreams resolves raw Caddyfile/JSON upstream selectors into
+// a default address plus magic- and conn_id-keyed lookup tables.
+func parseEasyTierUpstreams(upstreams map[string]string) (defaultUpstream string, magicUpstreams map[uint64]string, connIDUpstreams map[uint32]string, err error) {
+	magicUpstreams = make(map[uint64]string)
+	connIDUpstreams = make(map[uint32]string)
+
+	for selector, addr := range upstreams {
+		switch {
+		case selector == easyTierUpstreamDefaultSelector:
+			defaultUpstream = addr
+		case strings.HasPrefix(selector, easyTierUpstreamConnIDPrefix):
+			raw := strings.TrimPrefix(selector, easyTierUpstreamConnIDPrefix)
+			connID, parseErr := strconv.ParseUint(raw, 0, 32)
+			if parseErr != nil {
+				return "", nil, nil, fmt.Errorf("l4easytier: invalid conn_id upstream selector '%s': %v", selector, parseErr)
+			}
+			connIDUpstreams[uint32(connID)] = addr
+		default:
+			magic, parseErr := strconv.ParseUint(selector, 0, 64)
+			if parseErr != nil {
+				return "", nil, nil, fmt.Errorf("l4easytier: invalid magic upstream selector '%s': %v", selector, parseErr)
+			}
+			magicUpstreams[magic] = addr
+		}
+	}
+
+	return defaultUpstream, magicUpstreams, connIDUpstreams, nil
+}
+
+// Handle consumes the already-matched EasyTier handshake, then proxies the
+// connection to the upstream selected for its magic/conn_id. The consumed
+// handshake bytes are replayed ahead of cx when forwarding to the upstream,
+// so the backend still sees a valid, complete packet.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	buf := make([]byte, easyTierHandshakeBytes)
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return err
+	}
+
+	ok, msgTypeName, connID, magic := parseEasyTierConfigServerHandshake(buf)
+	if !ok {
+		return fmt.Errorf("l4easytier: not an EasyTier config-server handshake")
+	}
+
+	addr, ok := h.upstreamFor(magic, connID)
+	if !ok {
+		return fmt.Errorf("l4easytier: no upstream configured for magic 0x%016X", magic)
+	}
+
+	h.logger.Info("accepted easytier handshake",
+		zap.String("msg_type", msgTypeName),
+		zap.Uint32("conn_id", connID),
+		zap.Uint64("magic", magic),
+		zap.String("client_addr", cx.RemoteAddr().String()),
+		zap.String("upstream", addr),
+	)
+
+	upstream, err := net.Dial(easyTierUpstreamNetwork(cx), addr)
+	if err != nil {
+		return fmt.Errorf("l4easytier: dialing upstream '%s': %w", addr, err)
+	}
+
+	fromClient := io.MultiReader(bytes.NewReader(buf), cx)
+
+	return proxyEasyTierConn(cx, fromClient, upstream)
+}
+
+// upstreamFor resolves the backend address for a handshake, preferring an
+// exact magic match, then a conn_id match, then the configured default.
+func (h *Handler) upstreamFor(magic uint64, connID uint32) (string, bool) {
+	if addr, ok := h.magicUpstreams[magic]; ok {
+		return addr, true
+	}
+	if addr, ok := h.connIDUpstreams[connID]; ok {
+		return addr, true
+	}
+	if h.defaultUpstream != "" {
+		return h.defaultUpstream, true
+	}
+	return "", false
+}
+
+// easyTierUpstreamNetwork picks the dial network matching the client connection.
+func easyTierUpstreamNetwork(cx *layer4.Connection) string {
+	if _, ok := cx.LocalAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// closeWriter is implemented by connections that support a TCP-style
+// half-close, letting one direction of a proxied connection drain after the
+// other has finished.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// proxyEasyTierConn copies fromClient to upstream and upstream to cx
+// concurrently. When one direction finishes, its destination is half-closed
+// for writes (falling back to a full close if the connection doesn't support
+// that) so the other, still-active direction can keep draining instead of
+// being truncated. Both ends are fully closed once both directions finish.
+func proxyEasyTierConn(cx *layer4.Connection, fromClient io.Reader, upstream net.Conn) error {
+	errs := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(upstream, fromClient)
+		halfCloseWrite(upstream)
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(cx, upstream)
+		halfCloseWrite(cx)
+		errs <- err
+	}()
+
+	firstErr := <-errs
+	secondErr := <-errs
+
+	_ = upstream.Close()
+	_ = cx.Close()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return secondErr
+}
+
+// halfCloseWrite closes the write side of conn, if supported, so its peer
+// sees a clean EOF while reads already in flight can still complete.
+func halfCloseWrite(conn io.Closer) {
+	if cw, ok := conn.(closeWriter); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	easytier {
+//		upstream <magic|conn:<conn_id>|default> <address>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(d.Nesting()) {
+		switch d.Val() {
+		case "upstream":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if h.Upstreams == nil {
+				h.Upstreams = make(map[string]string)
+			}
+			h.Upstreams[args[0]] = args[1]
+		default:
+			return d.Errf("unrecognized subdirective '%s' for '%s'", d.Val(), wrapper)
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+)
+
+const (
+	easyTierUpstreamDefaultSelector = "default"
+	easyTierUpstreamConnIDPrefix    = "conn:"
+)
@@ -0,0 +1,235 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4easytier
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func TestParseEasyTierUpstreams(t *testing.T) {
+	t.Run("valid selectors", func(t *testing.T) {
+		defaultUpstream, magicUpstreams, connIDUpstreams, err := parseEasyTierUpstreams(map[string]string{
+			"default":             "10.0.0.3:11010",
+			"0x0123456789ABCDEF":  "10.0.0.1:11010",
+			"1311768467750121216": "10.0.0.4:11010",
+			"conn:0xAABBCCDD":     "10.0.0.2:11010",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if defaultUpstream != "10.0.0.3:11010" {
+			t.Fatalf("expected default upstream 10.0.0.3:11010, got %q", defaultUpstream)
+		}
+		if addr := magicUpstreams[0x0123456789ABCDEF]; addr != "10.0.0.1:11010" {
+			t.Fatalf("expected hex magic upstream 10.0.0.1:11010, got %q", addr)
+		}
+		if addr := magicUpstreams[1311768467750121216]; addr != "10.0.0.4:11010" {
+			t.Fatalf("expected decimal magic upstream 10.0.0.4:11010, got %q", addr)
+		}
+		if addr := connIDUpstreams[0xAABBCCDD]; addr != "10.0.0.2:11010" {
+			t.Fatalf("expected conn_id upstream 10.0.0.2:11010, got %q", addr)
+		}
+	})
+
+	t.Run("invalid magic selector", func(t *testing.T) {
+		if _, _, _, err := parseEasyTierUpstreams(map[string]string{"not-a-number": "10.0.0.1:11010"}); err == nil {
+			t.Fatalf("expected an error for an invalid magic selector")
+		}
+	})
+
+	t.Run("invalid conn_id selector", func(t *testing.T) {
+		if _, _, _, err := parseEasyTierUpstreams(map[string]string{"conn:not-a-number": "10.0.0.1:11010"}); err == nil {
+			t.Fatalf("expected an error for an invalid conn_id selector")
+		}
+	})
+}
+
+func TestHandler_upstreamFor(t *testing.T) {
+	h := &Handler{
+		defaultUpstream: "10.0.0.3:11010",
+		magicUpstreams: map[uint64]string{
+			0x0123456789ABCDEF: "10.0.0.1:11010",
+		},
+		connIDUpstreams: map[uint32]string{
+			0xAABBCCDD: "10.0.0.2:11010",
+		},
+	}
+
+	tests := []struct {
+		name       string
+		magic      uint64
+		connID     uint32
+		expectAddr string
+		expectOK   bool
+	}{
+		{
+			name:       "matches-magic",
+			magic:      0x0123456789ABCDEF,
+			connID:     0x00000000,
+			expectAddr: "10.0.0.1:11010",
+			expectOK:   true,
+		},
+		{
+			name:       "falls-back-to-conn-id",
+			magic:      0xFFFFFFFFFFFFFFFF,
+			connID:     0xAABBCCDD,
+			expectAddr: "10.0.0.2:11010",
+			expectOK:   true,
+		},
+		{
+			name:       "falls-back-to-default",
+			magic:      0xFFFFFFFFFFFFFFFF,
+			connID:     0x00000000,
+			expectAddr: "10.0.0.3:11010",
+			expectOK:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, ok := h.upstreamFor(tc.magic, tc.connID)
+			if ok != tc.expectOK {
+				t.Fatalf("expected ok=%v, got %v", tc.expectOK, ok)
+			}
+			if addr != tc.expectAddr {
+				t.Fatalf("expected addr %q, got %q", tc.expectAddr, addr)
+			}
+		})
+	}
+}
+
+func TestHandler_upstreamFor_NoMatch(t *testing.T) {
+	h := &Handler{}
+
+	if _, ok := h.upstreamFor(0x0123456789ABCDEF, 0xAABBCCDD); ok {
+		t.Fatalf("expected no upstream to match")
+	}
+}
+
+func TestEasyTierUpstreamNetwork(t *testing.T) {
+	_, server := net.Pipe()
+	t.Cleanup(func() { _ = server.Close() })
+
+	udpConn := &fakeUDPConn{Conn: server}
+	cx := layer4.WrapConnection(udpConn, []byte{}, zap.NewNop())
+	if network := easyTierUpstreamNetwork(cx); network != "udp" {
+		t.Fatalf("expected udp, got %s", network)
+	}
+
+	tcpConn := &fakeTCPConn{Conn: server}
+	cx = layer4.WrapConnection(tcpConn, []byte{}, zap.NewNop())
+	if network := easyTierUpstreamNetwork(cx); network != "tcp" {
+		t.Fatalf("expected tcp, got %s", network)
+	}
+}
+
+// TestHandler_Handle_PreservesHandshakeBytes drives Handle end-to-end against
+// a real TCP listener standing in for the upstream, and asserts that the
+// backend receives the original 16 handshake bytes first, i.e. that Handle's
+// io.MultiReader genuinely replays what it already consumed from cx.
+func TestHandler_Handle_PreservesHandshakeBytes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	upstreamConns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			upstreamConns <- conn
+		}
+	}()
+
+	h := &Handler{
+		defaultUpstream: listener.Addr().String(),
+		magicUpstreams:  map[uint64]string{},
+		connIDUpstreams: map[uint32]string{},
+		logger:          zap.NewNop(),
+	}
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+
+	serverConn := &fakeTCPConn{Conn: server}
+	cx := layer4.WrapConnection(serverConn, []byte{}, zap.NewNop())
+
+	packet := newHandshakePacket(easyTierMsgTypeSyn, easyTierPaddingValue, easyTierPayloadBytes)
+	go func() {
+		_, _ = client.Write(packet)
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Handle(cx, nil)
+	}()
+
+	var upstreamConn net.Conn
+	select {
+	case upstreamConn = <-upstreamConns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for upstream connection")
+	}
+	t.Cleanup(func() { _ = upstreamConn.Close() })
+
+	received := make([]byte, len(packet))
+	if _, err := io.ReadFull(upstreamConn, received); err != nil {
+		t.Fatalf("failed to read handshake from upstream: %v", err)
+	}
+
+	if !bytes.Equal(received, packet) {
+		t.Fatalf("expected upstream to receive the original handshake bytes %x, got %x", packet, received)
+	}
+
+	_ = client.Close()
+	_ = upstreamConn.Close()
+
+	select {
+	case err := <-done:
+		assertNoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Handle to return")
+	}
+}
+
+func TestHandler_Handle_NoUpstream(t *testing.T) {
+	h := &Handler{logger: zap.NewNop()}
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+
+	serverConn := &fakeTCPConn{Conn: server}
+	cx := layer4.WrapConnection(serverConn, []byte{}, zap.NewNop())
+
+	packet := newHandshakePacket(easyTierMsgTypeSyn, easyTierPaddingValue, easyTierPayloadBytes)
+	go func() {
+		_, _ = client.Write(packet)
+		_ = client.Close()
+	}()
+
+	if err := h.Handle(cx, nil); err == nil {
+		t.Fatal("expected an error when no upstream is configured")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"strconv"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -30,7 +31,27 @@ func init() {
 }
 
 // MatchEasyTierConfigServer matches EasyTier config-server handshake packets.
-type MatchEasyTierConfigServer struct{}
+//
+// By default any well-formed handshake matches. AllowMagics, DenyMagics,
+// AllowConnIDs, and RequireMsgTypes can be set to additionally gate which
+// handshakes are admitted, letting a listener accept only the EasyTier
+// networks an operator intends to serve.
+type MatchEasyTierConfigServer struct {
+	// AllowMagics, if non-empty, restricts matches to handshakes whose magic
+	// is in this list.
+	AllowMagics []uint64 `json:"allow_magics,omitempty"`
+
+	// DenyMagics, if non-empty, rejects handshakes whose magic is in this list.
+	DenyMagics []uint64 `json:"deny_magics,omitempty"`
+
+	// AllowConnIDs, if non-empty, restricts matches to handshakes whose
+	// conn_id is in this list.
+	AllowConnIDs []uint32 `json:"allow_conn_ids,omitempty"`
+
+	// RequireMsgTypes, if non-empty, restricts matches to handshakes whose
+	// message type name (syn or sack) is in this list.
+	RequireMsgTypes []string `json:"require_msg_types,omitempty"`
+}
 
 // CaddyModule returns the Caddy module information.
 func (*MatchEasyTierConfigServer) CaddyModule() caddy.ModuleInfo {
@@ -40,7 +61,8 @@ func (*MatchEasyTierConfigServer) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// Match returns true if the connection looks like an EasyTier config-server handshake.
+// Match returns true if the connection looks like an EasyTier config-server
+// handshake that also satisfies the configured allow/deny rules.
 func (m *MatchEasyTierConfigServer) Match(cx *layer4.Connection) (bool, error) {
 	if _, ok := cx.LocalAddr().(*net.UDPAddr); !ok {
 		return false, nil
@@ -51,38 +73,74 @@ func (m *MatchEasyTierConfigServer) Match(cx *layer4.Connection) (bool, error) {
 		return false, err
 	}
 
-	msgType := buf[easyTierMsgTypeOffset]
-	var msgTypeName string
-	switch msgType {
+	ok, msgTypeName, connID, magic := parseEasyTierConfigServerHandshake(buf)
+	if !ok {
+		return false, nil
+	}
+
+	if len(m.RequireMsgTypes) > 0 && !containsString(m.RequireMsgTypes, msgTypeName) {
+		return false, nil
+	}
+
+	if len(m.AllowMagics) > 0 && !containsUint64(m.AllowMagics, magic) {
+		return false, nil
+	}
+
+	if len(m.DenyMagics) > 0 && containsUint64(m.DenyMagics, magic) {
+		return false, nil
+	}
+
+	if len(m.AllowConnIDs) > 0 && !containsUint32(m.AllowConnIDs, connID) {
+		return false, nil
+	}
+
+	if repl, ok := cx.Context.Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok && repl != nil {
+		repl.Set(replacerKeyConnID, connID)
+		repl.Set(replacerKeyMsgType, msgTypeName)
+		repl.Set(replacerKeyMagic, magic)
+	}
+
+	return true, nil
+}
+
+// parseEasyTierConfigServerHandshake validates buf as an EasyTier
+// config-server handshake and extracts its msg type name, conn_id, and
+// magic. buf must be easyTierHandshakeBytes long.
+func parseEasyTierConfigServerHandshake(buf []byte) (ok bool, msgTypeName string, connID uint32, magic uint64) {
+	switch buf[easyTierMsgTypeOffset] {
 	case easyTierMsgTypeSyn:
 		msgTypeName = easyTierMsgTypeSynName
 	case easyTierMsgTypeSack:
 		msgTypeName = easyTierMsgTypeSackName
 	default:
-		return false, nil
+		return false, "", 0, 0
 	}
 
 	if buf[easyTierPaddingOffset] != easyTierPaddingValue {
-		return false, nil
+		return false, "", 0, 0
 	}
 
 	payloadLen := binary.LittleEndian.Uint16(buf[easyTierLengthOffset : easyTierLengthOffset+easyTierLengthBytes])
 	if payloadLen != easyTierPayloadBytes {
-		return false, nil
+		return false, "", 0, 0
 	}
 
-	if repl, ok := cx.Context.Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok && repl != nil {
-		repl.Set(replacerKeyConnID, binary.LittleEndian.Uint32(buf[:easyTierMsgTypeOffset]))
-		repl.Set(replacerKeyMsgType, msgTypeName)
-		repl.Set(replacerKeyMagic, binary.LittleEndian.Uint64(buf[easyTierMagicOffset:]))
-	}
+	connID = binary.LittleEndian.Uint32(buf[:easyTierMsgTypeOffset])
+	magic = binary.LittleEndian.Uint64(buf[easyTierMagicOffset:])
 
-	return true, nil
+	return true, msgTypeName, connID, magic
 }
 
 // UnmarshalCaddyfile sets up the MatchEasyTierConfigServer from Caddyfile tokens. Syntax:
 //
-//	easytier_config_server
+//	easytier_config_server {
+//		allow_magics   <uint64>...
+//		deny_magics    <uint64>...
+//		allow_conn_ids <uint32>...
+//		require_msg_types <syn|sack>...
+//	}
+//
+// Magics and conn_ids may be written in hex (e.g. 0x0123456789ABCDEF) or decimal.
 func (m *MatchEasyTierConfigServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	_, wrapper := d.Next(), d.Val() // consume wrapper name
 
@@ -90,13 +148,93 @@ func (m *MatchEasyTierConfigServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) e
 		return d.ArgErr()
 	}
 
-	if d.NextBlock(d.Nesting()) {
-		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	for d.NextBlock(d.Nesting()) {
+		subdirective := d.Val()
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+
+		switch subdirective {
+		case "allow_magics":
+			magics, err := parseUint64Args(d, args)
+			if err != nil {
+				return err
+			}
+			m.AllowMagics = append(m.AllowMagics, magics...)
+		case "deny_magics":
+			magics, err := parseUint64Args(d, args)
+			if err != nil {
+				return err
+			}
+			m.DenyMagics = append(m.DenyMagics, magics...)
+		case "allow_conn_ids":
+			connIDs, err := parseUint32Args(d, args)
+			if err != nil {
+				return err
+			}
+			m.AllowConnIDs = append(m.AllowConnIDs, connIDs...)
+		case "require_msg_types":
+			m.RequireMsgTypes = append(m.RequireMsgTypes, args...)
+		default:
+			return d.Errf("unrecognized subdirective '%s' for '%s'", subdirective, wrapper)
+		}
 	}
 
 	return nil
 }
 
+func parseUint64Args(d *caddyfile.Dispenser, args []string) ([]uint64, error) {
+	values := make([]uint64, 0, len(args))
+	for _, arg := range args {
+		value, err := strconv.ParseUint(arg, 0, 64)
+		if err != nil {
+			return nil, d.Errf("invalid uint64 value '%s': %v", arg, err)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func parseUint32Args(d *caddyfile.Dispenser, args []string) ([]uint32, error) {
+	values := make([]uint32, 0, len(args))
+	for _, arg := range args {
+		value, err := strconv.ParseUint(arg, 0, 32)
+		if err != nil {
+			return nil, d.Errf("invalid uint32 value '%s': %v", arg, err)
+		}
+		values = append(values, uint32(value))
+	}
+	return values, nil
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint32(haystack []uint32, needle uint32) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint64(haystack []uint64, needle uint64) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
 // Interface guards
 var (
 	_ layer4.ConnMatcher    = (*MatchEasyTierConfigServer)(nil)
@@ -161,6 +161,75 @@ func TestMatchEasyTierConfigServer_Match(t *testing.T) {
 	}
 }
 
+func TestMatchEasyTierConfigServer_Match_Filters(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher *MatchEasyTierConfigServer
+		expect  bool
+	}{
+		{
+			name:    "allow_magics-matches",
+			matcher: &MatchEasyTierConfigServer{AllowMagics: []uint64{0x0123456789ABCDEF}},
+			expect:  true,
+		},
+		{
+			name:    "allow_magics-rejects",
+			matcher: &MatchEasyTierConfigServer{AllowMagics: []uint64{0xFFFFFFFFFFFFFFFF}},
+			expect:  false,
+		},
+		{
+			name:    "deny_magics-rejects",
+			matcher: &MatchEasyTierConfigServer{DenyMagics: []uint64{0x0123456789ABCDEF}},
+			expect:  false,
+		},
+		{
+			name:    "allow_conn_ids-matches",
+			matcher: &MatchEasyTierConfigServer{AllowConnIDs: []uint32{0xAABBCCDD}},
+			expect:  true,
+		},
+		{
+			name:    "allow_conn_ids-rejects",
+			matcher: &MatchEasyTierConfigServer{AllowConnIDs: []uint32{0x00000000}},
+			expect:  false,
+		},
+		{
+			name:    "require_msg_types-matches",
+			matcher: &MatchEasyTierConfigServer{RequireMsgTypes: []string{easyTierMsgTypeSynName}},
+			expect:  true,
+		},
+		{
+			name:    "require_msg_types-rejects",
+			matcher: &MatchEasyTierConfigServer{RequireMsgTypes: []string{easyTierMsgTypeSackName}},
+			expect:  false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			t.Cleanup(func() { _ = client.Close() })
+
+			serverConn := &fakeUDPConn{Conn: server}
+			t.Cleanup(func() { _ = serverConn.Close() })
+
+			cx := layer4.WrapConnection(serverConn, []byte{}, zap.NewNop())
+
+			packet := newHandshakePacket(easyTierMsgTypeSyn, easyTierPaddingValue, easyTierPayloadBytes)
+			go func() {
+				_, _ = client.Write(packet)
+				_ = client.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.expect {
+				t.Fatalf("expected match=%v, got %v", tc.expect, matched)
+			}
+		})
+	}
+}
+
 func newHandshakePacket(msgType uint8, padding uint8, payloadLen uint16) []byte {
 	packet := make([]byte, easyTierHandshakeBytes)
 	binary.LittleEndian.PutUint32(packet[:4], 0xAABBCCDD)
@@ -0,0 +1,370 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4easytier
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func TestMatchEasyTierPeerTCP_Match(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		useTCP bool
+		expect bool
+	}{
+		{
+			name:   "handshake",
+			packet: newPeerTCPPacket(easyTierMsgTypePeerHandshake, easyTierPeerTCPPayloadBytes),
+			useTCP: true,
+			expect: true,
+		},
+		{
+			name:   "unexpected-msg-type",
+			packet: newPeerTCPPacket(0x99, easyTierPeerTCPPayloadBytes),
+			useTCP: true,
+			expect: false,
+		},
+		{
+			name:   "unexpected-length",
+			packet: newPeerTCPPacket(easyTierMsgTypePeerHandshake, easyTierPeerTCPPayloadBytes+1),
+			useTCP: true,
+			expect: false,
+		},
+		{
+			name:   "non-tcp",
+			packet: nil,
+			useTCP: false,
+			expect: false,
+		},
+	}
+
+	matcher := &MatchEasyTierPeerTCP{}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			t.Cleanup(func() { _ = client.Close() })
+
+			var serverConn net.Conn = server
+			if tc.useTCP {
+				serverConn = &fakeTCPConn{Conn: server}
+			}
+			t.Cleanup(func() { _ = serverConn.Close() })
+
+			cx := layer4.WrapConnection(serverConn, []byte{}, zap.NewNop())
+
+			if len(tc.packet) > 0 {
+				go func() {
+					_, _ = client.Write(tc.packet)
+					_ = client.Close()
+				}()
+			} else {
+				go func() { _ = client.Close() }()
+			}
+
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.expect {
+				t.Fatalf("expected match=%v, got %v", tc.expect, matched)
+			}
+
+			if matched {
+				assertEasyTierPeerReplacerValues(t, cx, easyTierTransportTCP, 0xAABBCCDD, 0x11223344, 0x55667788, 0x0123456789ABCDEF)
+			}
+		})
+	}
+}
+
+func TestMatchEasyTierPeerQUIC_Match(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		useUDP bool
+		expect bool
+	}{
+		{
+			name:   "initial",
+			packet: newPeerQUICInitialPacket(easyTierQUICVersion1, easyTierQUICMinDCIDBytes),
+			useUDP: true,
+			expect: true,
+		},
+		{
+			name:   "unexpected-version",
+			packet: newPeerQUICInitialPacket(0xdeadbeef, easyTierQUICMinDCIDBytes),
+			useUDP: true,
+			expect: false,
+		},
+		{
+			name:   "short-dcid",
+			packet: newPeerQUICInitialPacket(easyTierQUICVersion1, easyTierQUICMinDCIDBytes-1),
+			useUDP: true,
+			expect: false,
+		},
+		{
+			name:   "unexpected-fingerprint",
+			packet: newPeerQUICInitialPacketWithFingerprint(easyTierQUICVersion1, easyTierQUICMinDCIDBytes, []byte{0x00, 0x00, 0x00, 0x00}),
+			useUDP: true,
+			expect: false,
+		},
+		{
+			name:   "ordinary-quic-long-dcid",
+			packet: newOrdinaryQUICInitialPacket(easyTierQUICVersion1, easyTierQUICMinDCIDBytes),
+			useUDP: true,
+			expect: false,
+		},
+		{
+			name:   "non-udp",
+			packet: nil,
+			useUDP: false,
+			expect: false,
+		},
+	}
+
+	matcher := &MatchEasyTierPeerQUIC{}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			t.Cleanup(func() { _ = client.Close() })
+
+			var serverConn net.Conn = server
+			if tc.useUDP {
+				serverConn = &fakeUDPConn{Conn: server}
+			}
+			t.Cleanup(func() { _ = serverConn.Close() })
+
+			cx := layer4.WrapConnection(serverConn, []byte{}, zap.NewNop())
+
+			if len(tc.packet) > 0 {
+				go func() {
+					_, _ = client.Write(tc.packet)
+					_ = client.Close()
+				}()
+			} else {
+				go func() { _ = client.Close() }()
+			}
+
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.expect {
+				t.Fatalf("expected match=%v, got %v", tc.expect, matched)
+			}
+
+			if matched {
+				assertEasyTierPeerReplacerValues(t, cx, easyTierTransportQUIC, 0, 0x11223344, 0x55667788, 0x0123456789ABCDEF)
+			}
+		})
+	}
+}
+
+func TestMatchEasyTierPeerWG_Match(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		useUDP bool
+		expect bool
+	}{
+		{
+			name:   "handshake-initiation",
+			packet: newPeerWGPacket(easyTierWGMsgTypeHandshakeInitiation, easyTierWGFingerprint),
+			useUDP: true,
+			expect: true,
+		},
+		{
+			name:   "unexpected-msg-type",
+			packet: newPeerWGPacket(0x02, easyTierWGFingerprint),
+			useUDP: true,
+			expect: false,
+		},
+		{
+			name:   "unexpected-fingerprint",
+			packet: newPeerWGPacket(easyTierWGMsgTypeHandshakeInitiation, []byte{0x00, 0x00, 0x00, 0x00}),
+			useUDP: true,
+			expect: false,
+		},
+		{
+			name:   "non-udp",
+			packet: nil,
+			useUDP: false,
+			expect: false,
+		},
+	}
+
+	matcher := &MatchEasyTierPeerWG{}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			t.Cleanup(func() { _ = client.Close() })
+
+			var serverConn net.Conn = server
+			if tc.useUDP {
+				serverConn = &fakeUDPConn{Conn: server}
+			}
+			t.Cleanup(func() { _ = serverConn.Close() })
+
+			cx := layer4.WrapConnection(serverConn, []byte{}, zap.NewNop())
+
+			if len(tc.packet) > 0 {
+				go func() {
+					_, _ = client.Write(tc.packet)
+					_ = client.Close()
+				}()
+			} else {
+				go func() { _ = client.Close() }()
+			}
+
+			matched, err := matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.expect {
+				t.Fatalf("expected match=%v, got %v", tc.expect, matched)
+			}
+
+			if matched {
+				assertEasyTierPeerReplacerValues(t, cx, easyTierTransportWG, 0xAABBCCDD, 0x11223344, 0x55667788, 0x0123456789ABCDEF)
+			}
+		})
+	}
+}
+
+func newPeerTCPPacket(msgType uint8, frameLen uint16) []byte {
+	packet := make([]byte, easyTierPeerTCPLengthBytes+1+easyTierPeerTCPPayloadBytes-1)
+	binary.BigEndian.PutUint16(packet[:easyTierPeerTCPLengthBytes], frameLen)
+	packet[easyTierPeerTCPLengthBytes] = msgType
+	payload := packet[easyTierPeerTCPLengthBytes+1:]
+	binary.LittleEndian.PutUint32(payload[0:4], 0xAABBCCDD)
+	binary.LittleEndian.PutUint32(payload[4:8], 0x11223344)
+	binary.LittleEndian.PutUint32(payload[8:12], 0x55667788)
+	binary.LittleEndian.PutUint64(payload[12:20], 0x0123456789ABCDEF)
+	return packet
+}
+
+func newPeerQUICInitialPacket(version uint32, dcidLen uint8) []byte {
+	return newPeerQUICInitialPacketWithFingerprint(version, dcidLen, easyTierQUICFingerprint)
+}
+
+// newOrdinaryQUICInitialPacket builds a QUIC v1 Initial packet from a client
+// that is not EasyTier but, as permitted by RFC 9000, still picks a long
+// DCID (e.g. one stuffing in LB/CDN routing info).
+func newOrdinaryQUICInitialPacket(version uint32, dcidLen uint8) []byte {
+	packet := make([]byte, easyTierQUICLongHeaderBytes+int(dcidLen))
+	packet[0] = easyTierQUICLongHeaderFormBit | easyTierQUICFixedBit | easyTierQUICPacketTypeInitial
+	binary.BigEndian.PutUint32(packet[1:5], version)
+	packet[5] = dcidLen
+	dcid := packet[easyTierQUICLongHeaderBytes:]
+	for i := range dcid {
+		dcid[i] = byte(i + 1)
+	}
+	return packet
+}
+
+func newPeerQUICInitialPacketWithFingerprint(version uint32, dcidLen uint8, fingerprint []byte) []byte {
+	packet := make([]byte, easyTierQUICLongHeaderBytes+int(dcidLen))
+	packet[0] = easyTierQUICLongHeaderFormBit | easyTierQUICFixedBit | easyTierQUICPacketTypeInitial
+	binary.BigEndian.PutUint32(packet[1:5], version)
+	packet[5] = dcidLen
+	dcid := packet[easyTierQUICLongHeaderBytes:]
+	fingerprintLen := len(fingerprint)
+	if len(dcid) >= fingerprintLen {
+		copy(dcid, fingerprint)
+	}
+	if len(dcid) >= fingerprintLen+16 {
+		binary.LittleEndian.PutUint64(dcid[fingerprintLen:fingerprintLen+8], 0x0123456789ABCDEF)
+		binary.LittleEndian.PutUint32(dcid[fingerprintLen+8:fingerprintLen+12], 0x11223344)
+		binary.LittleEndian.PutUint32(dcid[fingerprintLen+12:fingerprintLen+16], 0x55667788)
+	}
+	return packet
+}
+
+func newPeerWGPacket(msgType uint8, fingerprint []byte) []byte {
+	packet := make([]byte, easyTierWGHandshakeInitiationBytes+easyTierWGTrailerBytes)
+	packet[easyTierWGMsgTypeOffset] = msgType
+	binary.LittleEndian.PutUint32(packet[easyTierWGSenderIndexOffset:], 0xAABBCCDD)
+	trailer := packet[easyTierWGHandshakeInitiationBytes:]
+	copy(trailer, fingerprint)
+	fingerprintLen := len(easyTierWGFingerprint)
+	binary.LittleEndian.PutUint32(trailer[fingerprintLen:fingerprintLen+4], 0x11223344)
+	binary.LittleEndian.PutUint32(trailer[fingerprintLen+4:fingerprintLen+8], 0x55667788)
+	binary.LittleEndian.PutUint64(trailer[fingerprintLen+8:fingerprintLen+16], 0x0123456789ABCDEF)
+	return packet
+}
+
+func assertEasyTierPeerReplacerValues(t *testing.T, cx *layer4.Connection, transport string, connID, peerID, networkNameHash uint32, magic uint64) {
+	t.Helper()
+
+	repl := cx.Context.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	transportVal, ok := repl.Get(replacerKeyTransport)
+	if !ok {
+		t.Fatalf("expected replacer key %q to be set", replacerKeyTransport)
+	}
+	if transportVal.(string) != transport {
+		t.Fatalf("expected transport %q, got %q", transport, transportVal)
+	}
+
+	connIDVal, ok := repl.Get(replacerKeyConnID)
+	if !ok {
+		t.Fatalf("expected replacer key %q to be set", replacerKeyConnID)
+	}
+	if connIDVal.(uint32) != connID {
+		t.Fatalf("expected conn_id 0x%08X, got 0x%08X", connID, connIDVal)
+	}
+
+	peerIDVal, ok := repl.Get(replacerKeyPeerID)
+	if !ok {
+		t.Fatalf("expected replacer key %q to be set", replacerKeyPeerID)
+	}
+	if peerIDVal.(uint32) != peerID {
+		t.Fatalf("expected peer_id 0x%08X, got 0x%08X", peerID, peerIDVal)
+	}
+
+	networkNameHashVal, ok := repl.Get(replacerKeyNetworkNameHash)
+	if !ok {
+		t.Fatalf("expected replacer key %q to be set", replacerKeyNetworkNameHash)
+	}
+	if networkNameHashVal.(uint32) != networkNameHash {
+		t.Fatalf("expected network_name_hash 0x%08X, got 0x%08X", networkNameHash, networkNameHashVal)
+	}
+
+	magicVal, ok := repl.Get(replacerKeyMagic)
+	if !ok {
+		t.Fatalf("expected replacer key %q to be set", replacerKeyMagic)
+	}
+	if magicVal.(uint64) != magic {
+		t.Fatalf("expected magic 0x%016X, got 0x%016X", magic, magicVal)
+	}
+}
+
+type fakeTCPConn struct {
+	net.Conn
+}
+
+func (c *fakeTCPConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// Interface guard
+var _ net.Conn = (*fakeTCPConn)(nil)